@@ -0,0 +1,104 @@
+package geoserve
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIpFor determines the client IP for req. RemoteAddr is always the
+// fallback; X-Forwarded-For, Forwarded (RFC 7239) and X-Real-IP are only
+// honored when RemoteAddr falls within trustedProxies, since all three are
+// trivially spoofable by anyone who can reach the server directly.
+func clientIpFor(req *http.Request, trustedProxies []*net.IPNet) string {
+	remoteIP := remoteIPFor(req)
+	if !isTrustedProxy(remoteIP, trustedProxies) {
+		return remoteIP
+	}
+	if forwarded := req.Header.Get("Forwarded"); forwarded != "" {
+		if ip := parseForwardedHeader(forwarded); ip != "" {
+			return ip
+		}
+	}
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		// xff may contain multiple ips, use the first
+		ips := strings.Split(xff, ",")
+		return strings.TrimSpace(ips[0])
+	}
+	if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+		return strings.TrimSpace(realIP)
+	}
+	return remoteIP
+}
+
+// remoteIPFor extracts the bare IP from req.RemoteAddr, which is normally
+// host:port - using strings.Split on ":" breaks for IPv6 addresses, so this
+// uses net.SplitHostPort instead. A RemoteAddr without a port is returned
+// unchanged.
+func remoteIPFor(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// RemoteAddr didn't include a port; use it as-is.
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// isTrustedProxy reports whether ip falls within any of the given trusted
+// proxy CIDRs.
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range trustedProxies {
+		if cidr.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedHeader extracts the first "for=" identifier from an RFC 7239
+// Forwarded header, e.g. `for=192.0.2.60;proto=https, for="[2001:db8::1]"`.
+func parseForwardedHeader(header string) string {
+	firstHop := strings.Split(header, ",")[0]
+	for _, pair := range strings.Split(firstHop, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "for") {
+			continue
+		}
+		forValue := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		forValue = strings.TrimPrefix(forValue, "[")
+		if idx := strings.LastIndex(forValue, "]"); idx >= 0 {
+			forValue = forValue[:idx]
+		}
+		if host, _, err := net.SplitHostPort(forValue); err == nil {
+			return host
+		}
+		return forValue
+	}
+	return ""
+}
+
+// networkKeyFor returns the cache key to use for ip when the GeoServer is
+// configured to key by network rather than by exact IP: the containing /24
+// for IPv4, or /48 for IPv6. This trades per-IP precision for a much higher
+// cache hit ratio, which is reasonable since country/city-level lookups are
+// stable across an entire network block. Falls back to ip itself if it can't
+// be parsed.
+func networkKeyFor(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return v4.Mask(mask).String()
+	}
+	mask := net.CIDRMask(48, 128)
+	return parsed.Mask(mask).String()
+}
@@ -0,0 +1,145 @@
+package geoserve
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("unable to parse CIDR %s: %v", s, err)
+	}
+	return ipNet
+}
+
+func TestRemoteIPFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{"ipv4 with port", "203.0.113.5:1234", "203.0.113.5"},
+		{"ipv6 with port", "[2001:db8::1]:1234", "2001:db8::1"},
+		{"no port", "203.0.113.5", "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if got := remoteIPFor(req); got != tt.want {
+				t.Errorf("remoteIPFor(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	trusted := []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"203.0.113.5", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := isTrustedProxy(tt.ip, trusted); got != tt.want {
+			t.Errorf("isTrustedProxy(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if isTrustedProxy("10.1.2.3", nil) {
+		t.Error("isTrustedProxy with no trusted proxies should always be false")
+	}
+}
+
+func TestParseForwardedHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"simple", "for=192.0.2.60;proto=https", "192.0.2.60"},
+		{"quoted ipv6", `for="[2001:db8::1]:4711"`, "2001:db8::1"},
+		{"multiple hops uses first", "for=192.0.2.60, for=198.51.100.17", "192.0.2.60"},
+		{"no for param", "proto=https", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseForwardedHeader(tt.header); got != tt.want {
+				t.Errorf("parseForwardedHeader(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIpFor(t *testing.T) {
+	trusted := []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}
+
+	newReq := func(remoteAddr string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return req
+	}
+
+	t.Run("untrusted proxy headers are ignored", func(t *testing.T) {
+		req := newReq("203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+		if got := clientIpFor(req, trusted); got != "203.0.113.5" {
+			t.Errorf("clientIpFor = %q, want %q", got, "203.0.113.5")
+		}
+	})
+
+	t.Run("trusted proxy X-Forwarded-For comma list uses first", func(t *testing.T) {
+		req := newReq("10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.1"})
+		if got := clientIpFor(req, trusted); got != "198.51.100.1" {
+			t.Errorf("clientIpFor = %q, want %q", got, "198.51.100.1")
+		}
+	})
+
+	t.Run("trusted proxy Forwarded header takes precedence over X-Forwarded-For", func(t *testing.T) {
+		req := newReq("10.0.0.1:1234", map[string]string{
+			"Forwarded":       "for=198.51.100.2",
+			"X-Forwarded-For": "198.51.100.1",
+		})
+		if got := clientIpFor(req, trusted); got != "198.51.100.2" {
+			t.Errorf("clientIpFor = %q, want %q", got, "198.51.100.2")
+		}
+	})
+
+	t.Run("trusted proxy falls back to X-Real-IP", func(t *testing.T) {
+		req := newReq("10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.3"})
+		if got := clientIpFor(req, trusted); got != "198.51.100.3" {
+			t.Errorf("clientIpFor = %q, want %q", got, "198.51.100.3")
+		}
+	})
+
+	t.Run("no headers falls back to remote addr even when trusted", func(t *testing.T) {
+		req := newReq("10.0.0.1:1234", nil)
+		if got := clientIpFor(req, trusted); got != "10.0.0.1" {
+			t.Errorf("clientIpFor = %q, want %q", got, "10.0.0.1")
+		}
+	})
+}
+
+func TestNetworkKeyFor(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"203.0.113.42", "203.0.113.0"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234::"},
+		{"not-an-ip", "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := networkKeyFor(tt.ip); got != tt.want {
+			t.Errorf("networkKeyFor(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+
+	errors "github.com/getlantern/errors"
+)
+
+// Edition identifies a MaxMind database edition that a GeoServer can be
+// configured to load. Each edition corresponds to one .mmdb file inside a
+// MaxMind download archive.
+type Edition string
+
+const (
+	// EditionCountry is MaxMind's country-level database.
+	EditionCountry Edition = "GeoLite2-Country"
+	// EditionCity is MaxMind's city-level database, which also includes
+	// subdivision, location and postal data.
+	EditionCity Edition = "GeoLite2-City"
+	// EditionASN is MaxMind's autonomous system number database.
+	EditionASN Edition = "GeoLite2-ASN"
+	// EditionAnonymousIP is MaxMind's anonymizing-network database, used to
+	// flag VPNs, Tor exit nodes, public/residential proxies and hosting
+	// providers via LookupAnonymous.
+	EditionAnonymousIP Edition = "GeoIP2-Anonymous-IP"
+)
+
+// mmdbFilename returns the name of the .mmdb file for this edition inside a
+// MaxMind download archive.
+func (e Edition) mmdbFilename() string {
+	return string(e) + ".mmdb"
+}
+
+// Result is the geolocation information for a single IP address. Depending
+// on which database editions a GeoServer was configured with, some fields
+// may be nil. Marshaling a Result to JSON merges the fields of whichever
+// sub-results are present into a single flat object, matching the shape of
+// MaxMind's own combined City+ASN responses.
+type Result struct {
+	Country *geoip2.Country
+	City    *geoip2.City
+	ASN     *geoip2.ASN
+}
+
+// MarshalJSON merges the non-nil sub-results into a single JSON object. When
+// both Country and City are present, City takes precedence since it's a
+// superset of Country's fields. An empty Result marshals to {}.
+func (r *Result) MarshalJSON() ([]byte, error) {
+	merged := map[string]json.RawMessage{}
+	parts := make([]interface{}, 0, 3)
+	if r.City != nil {
+		parts = append(parts, r.City)
+	} else if r.Country != nil {
+		parts = append(parts, r.Country)
+	}
+	if r.ASN != nil {
+		parts = append(parts, r.ASN)
+	}
+	for _, part := range parts {
+		data, err := json.Marshal(part)
+		if err != nil {
+			return nil, errors.New("unable to marshal result part: %v", err)
+		}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, errors.New("unable to decode result part: %v", err)
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// lookup resolves ip against the given database readers, one per loaded
+// edition, and assembles a Result from whichever of them are present.
+func lookup(dbs map[Edition]*geoip2.Reader, ip net.IP) (*Result, error) {
+	result := &Result{}
+	if db, ok := dbs[EditionCity]; ok {
+		city, err := db.City(ip)
+		if err != nil {
+			return nil, errors.New("unable to look up city for ip address %s: %s", ip, err)
+		}
+		result.City = city
+	} else if db, ok := dbs[EditionCountry]; ok {
+		country, err := db.Country(ip)
+		if err != nil {
+			return nil, errors.New("unable to look up country for ip address %s: %s", ip, err)
+		}
+		result.Country = country
+	}
+	if db, ok := dbs[EditionASN]; ok {
+		asn, err := db.ASN(ip)
+		if err != nil {
+			return nil, errors.New("unable to look up ASN for ip address %s: %s", ip, err)
+		}
+		result.ASN = asn
+	}
+	return result, nil
+}
+
+// lookupAnonymous resolves ip against the EditionAnonymousIP database, which
+// must be loaded.
+func lookupAnonymous(dbs map[Edition]*geoip2.Reader, ip net.IP) (*geoip2.AnonymousIP, error) {
+	db, ok := dbs[EditionAnonymousIP]
+	if !ok {
+		return nil, errors.New("no %s database loaded", EditionAnonymousIP)
+	}
+	info, err := db.AnonymousIP(ip)
+	if err != nil {
+		return nil, errors.New("unable to look up anonymous IP status for %s: %s", ip, err)
+	}
+	return info, nil
+}
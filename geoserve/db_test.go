@@ -0,0 +1,96 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"testing"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+func TestResultMarshalJSON(t *testing.T) {
+	t.Run("city takes precedence over country", func(t *testing.T) {
+		result := &Result{
+			Country: &geoip2.Country{},
+			City:    &geoip2.City{},
+		}
+		result.City.Country.IsoCode = "US"
+		result.Country.Country.IsoCode = "CA"
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatalf("Marshal returned error: %v", err)
+		}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("unable to decode marshaled result: %v", err)
+		}
+		if _, ok := fields["City"]; !ok {
+			t.Error("expected merged result to include City's fields")
+		}
+		country := map[string]interface{}{}
+		if err := json.Unmarshal(fields["Country"], &country); err != nil {
+			t.Fatalf("unable to decode Country field: %v", err)
+		}
+		if country["IsoCode"] != "US" {
+			t.Errorf("Country.IsoCode = %v, want City's value %q, not Country's %q", country["IsoCode"], "US", "CA")
+		}
+	})
+
+	t.Run("country used when city is absent", func(t *testing.T) {
+		result := &Result{Country: &geoip2.Country{}}
+		result.Country.Country.IsoCode = "CA"
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatalf("Marshal returned error: %v", err)
+		}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("unable to decode marshaled result: %v", err)
+		}
+		country := map[string]interface{}{}
+		if err := json.Unmarshal(fields["Country"], &country); err != nil {
+			t.Fatalf("unable to decode Country field: %v", err)
+		}
+		if country["IsoCode"] != "CA" {
+			t.Errorf("Country.IsoCode = %v, want %q", country["IsoCode"], "CA")
+		}
+	})
+
+	t.Run("asn is merged alongside city", func(t *testing.T) {
+		result := &Result{
+			City: &geoip2.City{},
+			ASN:  &geoip2.ASN{},
+		}
+		result.ASN.AutonomousSystemNumber = 64512
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatalf("Marshal returned error: %v", err)
+		}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("unable to decode marshaled result: %v", err)
+		}
+		if _, ok := fields["City"]; !ok {
+			t.Error("expected merged result to include City's fields")
+		}
+		var asNumber float64
+		if err := json.Unmarshal(fields["AutonomousSystemNumber"], &asNumber); err != nil {
+			t.Fatalf("unable to decode AutonomousSystemNumber field: %v", err)
+		}
+		if asNumber != 64512 {
+			t.Errorf("AutonomousSystemNumber = %v, want 64512", asNumber)
+		}
+	})
+
+	t.Run("empty result marshals to an empty object", func(t *testing.T) {
+		data, err := json.Marshal(&Result{})
+		if err != nil {
+			t.Fatalf("Marshal returned error: %v", err)
+		}
+		if string(data) != "{}" {
+			t.Errorf("Marshal(&Result{}) = %s, want {}", data)
+		}
+	})
+}
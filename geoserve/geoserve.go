@@ -3,14 +3,17 @@ package geoserve
 import (
 	"encoding/json"
 	gerrors "errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/golang/groupcache/lru"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/mholt/archiver/v3"
 	geoip2 "github.com/oschwald/geoip2-golang"
 
@@ -21,6 +24,16 @@ import (
 
 const (
 	CacheSize = 50000
+
+	// maxMindDownloadURL is the template for MaxMind's official GeoIP download
+	// service. See https://dev.maxmind.com/geoip/updating-databases/#direct-downloads
+	maxMindDownloadURL = "https://download.maxmind.com/app/geoip_download?edition_id=%s&license_key=%s&suffix=tar.gz"
+
+	fileScheme = "file://"
+
+	// anonymousCacheKeyPrefix distinguishes HandleAnonymous's cached results
+	// from Handle's in the shared lookup cache.
+	anonymousCacheKeyPrefix = "anon:"
 )
 
 var (
@@ -28,48 +41,124 @@ var (
 	errNotModified = gerrors.New("unmodified")
 )
 
-// GeoServer is a server for IP geolocation information
+// GeoServer is a server for IP geolocation information. Lookups run fully in
+// parallel, guarded only by a read lock on the database editions; the write
+// lock is only ever held briefly while keepDbCurrent swaps in a freshly
+// downloaded database.
 type GeoServer struct {
-	db       *geoip2.Reader
-	dbURL    string
-	cache    *lru.Cache
-	cacheGet chan get
-	dbUpdate chan *geoip2.Reader
+	mu             sync.RWMutex
+	dbs            map[Edition]*geoip2.Reader
+	cache          *lru.Cache[string, []byte]
+	metrics        *metrics
+	trustedProxies []*net.IPNet
+	cacheByNetwork bool
 }
 
-// get encapsulates a request to geolocate an ip address
-type get struct {
-	ip   string
-	resp chan []byte
+// DBSource identifies where to load a single database Edition from. If DBFile
+// is set, the initial database is read from it; otherwise it is loaded from
+// DBURL. Whenever DBURL is set, keepDbCurrent watches it for updates, even if
+// the initial database came from DBFile. DBURL may be an http(s):// URL pointing at a MaxMind-style tar.gz archive,
+// or a file:// URL pointing at an uncompressed .mmdb file that's kept up to
+// date by some other process (e.g. geoipupdate) - in the latter case, the
+// file's mtime is used to detect updates instead of an HTTP Last-Modified
+// header.
+type DBSource struct {
+	Edition Edition
+	DBFile  string
+	DBURL   string
 }
 
-// NewServer constructs a new GeoServer using the (optional) uncompressed dbFile.
-// If dbFile is "", then this will fetch the latest GeoLite2-City database from
-// the specified DBURL
-func NewServer(dbFile, dbURL string) (server *GeoServer, err error) {
+// NewServer constructs a new GeoServer using the (optional) uncompressed dbFile
+// containing a GeoLite2-Country database. If dbFile is "", then this will fetch
+// the latest GeoLite2-Country database from the specified dbURL instead. This is
+// a convenience wrapper around NewServerForEditions for the common single-edition
+// case; use NewServerForEditions directly to load City and/or ASN data as well.
+// An optional Options may be passed to tune retry/backoff behavior.
+func NewServer(dbFile, dbURL string, opts ...Options) (server *GeoServer, err error) {
+	return NewServerForEditions(firstOptionsOrDefault(opts), DBSource{Edition: EditionCountry, DBFile: dbFile, DBURL: dbURL})
+}
+
+// NewServerWithMaxMind constructs a new GeoServer the same way as NewServer, except
+// that instead of supplying an explicit dbURL, callers supply their MaxMind license
+// key and the edition they're licensed for. The official MaxMind download URL is
+// built automatically and kept current the same way a manually supplied dbURL
+// would be.
+func NewServerWithMaxMind(dbFile, licenseKey string, edition Edition, opts ...Options) (server *GeoServer, err error) {
+	if licenseKey == "" {
+		return nil, errors.New("licenseKey is required")
+	}
+	if edition == "" {
+		return nil, errors.New("edition is required")
+	}
+	return NewServerForEditions(firstOptionsOrDefault(opts), DBSource{Edition: edition, DBFile: dbFile, DBURL: maxMindURL(string(edition), licenseKey)})
+}
+
+// NewServerForEditions constructs a new GeoServer that loads one or more database
+// editions, one per source. When more than one source is given, Lookup and Handle
+// return results merged across all of them (e.g. City plus ASN). opts controls
+// retry/backoff behavior for sources loaded from a URL.
+func NewServerForEditions(opts Options, sources ...DBSource) (server *GeoServer, err error) {
+	cache, err := lru.New[string, []byte](CacheSize)
+	if err != nil {
+		return nil, errors.New("unable to create cache: %v", err)
+	}
 	server = &GeoServer{
-		cache:    lru.New(CacheSize),
-		cacheGet: make(chan get, 10000),
-		dbUpdate: make(chan *geoip2.Reader),
+		dbs:            make(map[Edition]*geoip2.Reader, len(sources)),
+		cache:          cache,
+		trustedProxies: opts.TrustedProxies,
+		cacheByNetwork: opts.CacheByNetwork,
 	}
-	var lastModified time.Time
-	if dbFile != "" {
-		server.db, lastModified, err = readDbFromFile(dbFile)
-		if err != nil {
-			return nil, errors.New("unable to read DB from file: %v", err)
+	server.metrics = newMetrics(opts.Registry, server.cache.Len)
+	lastModifiedByEdition := make(map[Edition]time.Time, len(sources))
+	for _, source := range sources {
+		var db *geoip2.Reader
+		var lastModified time.Time
+		if source.DBFile != "" {
+			db, lastModified, err = readDbFromFile(source.DBFile)
+			if err != nil {
+				closeDbs(server.dbs)
+				return nil, errors.New("unable to read %s DB from file: %v", source.Edition, err)
+			}
+		} else {
+			err = withRetry(opts.Retry, func() error {
+				var e error
+				db, lastModified, e = readDbFromURL(source.Edition, source.DBURL, time.Time{})
+				return e
+			})
+			if err != nil {
+				server.metrics.recordDbUpdateFailure(source.Edition)
+				closeDbs(server.dbs)
+				return nil, errors.New("unable to read %s DB from %s: %v", source.Edition, source.DBURL, err)
+			}
 		}
-	} else {
-		server.dbURL = dbURL
-		server.db, lastModified, err = readDbFromWeb(server.dbURL, time.Time{})
-		if err != nil {
-			return nil, errors.New("unable to read DB from web: %v", err)
+		server.metrics.recordDbUpdateSuccess(source.Edition, lastModified)
+		server.dbs[source.Edition] = db
+		lastModifiedByEdition[source.Edition] = lastModified
+	}
+	// Only start the keepDbCurrent goroutines once every source has loaded
+	// successfully, so a failure partway through doesn't leave earlier
+	// editions' update loops running forever against an unreachable server.
+	for _, source := range sources {
+		if source.DBURL != "" {
+			go server.keepDbCurrent(source.Edition, source.DBURL, lastModifiedByEdition[source.Edition], opts.Retry)
 		}
 	}
-	go server.run()
-	if len(dbURL) > 0 {
-		go server.keepDbCurrent(lastModified)
+	return server, nil
+}
+
+// closeDbs closes every already-opened database reader. It's used to avoid
+// leaking file descriptors when NewServerForEditions fails partway through
+// loading multiple sources.
+func closeDbs(dbs map[Edition]*geoip2.Reader) {
+	for _, db := range dbs {
+		db.Close()
 	}
-	return
+}
+
+// maxMindURL builds the official MaxMind geoip_download URL for the given edition
+// and license key.
+func maxMindURL(editionID, licenseKey string) string {
+	return fmt.Sprintf(maxMindDownloadURL, url.QueryEscape(editionID), url.QueryEscape(licenseKey))
 }
 
 // Handle is used to handle requests from an HTTP server. basePath is the path
@@ -84,83 +173,181 @@ func (server *GeoServer) Handle(resp http.ResponseWriter, req *http.Request, bas
 	// Use path as ip
 	ip := path
 	if ip == "" {
-		// When no path supplied, grab remote address or X-Forwarded-For
-		ip = clientIpFor(req)
-	}
-	g := get{ip, make(chan []byte)}
-	server.cacheGet <- g
-	jsonData := <-g.resp
-	if jsonData == nil {
-		resp.WriteHeader(500)
+		// When no path supplied, grab remote address or a trusted forwarding header
+		ip = clientIpFor(req, server.trustedProxies)
+	}
+	jsonData, err := server.lookupCached(ip)
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusInternalServerError
+		log.Error(err)
+		resp.WriteHeader(status)
 	} else {
 		resp.Header().Set("X-Reflected-Ip", ip)
 		resp.Write(jsonData)
 	}
+	server.metrics.recordHandleStatus(endpointGeo, status)
 }
 
-// run runs the geolocation routine which takes care of looking up values from
-// the cache, updating the cache and udpating the database when a new version is
-// available.
-func (server *GeoServer) run() {
-	for {
-		select {
-		case g := <-server.cacheGet:
-
-			if cached, found := server.cache.Get(g.ip); found {
-				log.Trace("Cache hit")
-				g.resp <- cached.([]byte)
-			} else {
-				jsonData, err := server.lookupDB(g.ip)
-				if err != nil {
-					log.Error(err)
-				} else {
-					server.cache.Add(g.ip, jsonData)
-				}
-				g.resp <- jsonData
-			}
-		case db := <-server.dbUpdate:
-			if server.db != nil {
-				log.Debug("Closing old database")
-				server.db.Close()
-			}
-			log.Debug("Applying new database")
-			server.db = db
-			log.Debug("Clearing cached lookups")
-			server.cache = lru.New(CacheSize)
-		}
+// lookupCached serves ip out of the cache if present, falling back to the
+// database editions and populating the cache on a miss. The cache is safe
+// for concurrent use, so this takes no locks of its own.
+func (server *GeoServer) lookupCached(ip string) ([]byte, error) {
+	start := time.Now()
+	defer func() { server.metrics.observeLookupLatency(endpointGeo, time.Since(start)) }()
+	cacheKey := ip
+	if server.cacheByNetwork {
+		cacheKey = networkKeyFor(ip)
+	}
+	if cached, found := server.cache.Get(cacheKey); found {
+		log.Trace("Cache hit")
+		server.metrics.recordCacheHit(endpointGeo)
+		return cached, nil
+	}
+	server.metrics.recordCacheMiss(endpointGeo)
+	jsonData, err := server.lookupDB(ip)
+	if err != nil {
+		return nil, err
+	}
+	server.cache.Add(cacheKey, jsonData)
+	return jsonData, nil
+}
+
+// Lookup resolves ip to a Result using whichever database editions this
+// GeoServer was constructed with. Multiple goroutines may call Lookup
+// concurrently; it only ever blocks behind a brief write lock while
+// keepDbCurrent is swapping in a freshly downloaded database.
+func (server *GeoServer) Lookup(ip string) (*Result, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, errors.New("unable to parse ip address %s", ip)
 	}
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return lookup(server.dbs, parsedIP)
+}
+
+// HandleAnonymous is used to handle requests from an HTTP server for
+// anonymizing-network status (VPN, Tor exit node, public/residential proxy or
+// hosting provider). It requires a GeoServer configured with EditionAnonymousIP;
+// basePath and allowOrigin behave the same as for Handle.
+func (server *GeoServer) HandleAnonymous(resp http.ResponseWriter, req *http.Request, basePath string, allowOrigin string) {
+	if allowOrigin != "" {
+		(resp).Header().Set("Access-Control-Allow-Origin", allowOrigin)
+	}
+	path := strings.Replace(req.URL.Path, basePath, "", 1)
+	ip := path
+	if ip == "" {
+		ip = clientIpFor(req, server.trustedProxies)
+	}
+	jsonData, err := server.lookupAnonymousCached(ip)
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusInternalServerError
+		log.Error(err)
+		resp.WriteHeader(status)
+	} else {
+		resp.Header().Set("X-Reflected-Ip", ip)
+		resp.Write(jsonData)
+	}
+	server.metrics.recordHandleStatus(endpointAnonymous, status)
+}
+
+// lookupAnonymousCached serves ip's anonymizing-network status out of the
+// cache if present, falling back to the EditionAnonymousIP database on a
+// miss. It shares the lookup cache with lookupCached, under a distinct key
+// prefix so the two kinds of result never collide.
+func (server *GeoServer) lookupAnonymousCached(ip string) ([]byte, error) {
+	start := time.Now()
+	defer func() { server.metrics.observeLookupLatency(endpointAnonymous, time.Since(start)) }()
+	cacheKey := anonymousCacheKeyPrefix + ip
+	if cached, found := server.cache.Get(cacheKey); found {
+		log.Trace("Cache hit")
+		server.metrics.recordCacheHit(endpointAnonymous)
+		return cached, nil
+	}
+	server.metrics.recordCacheMiss(endpointAnonymous)
+	result, err := server.LookupAnonymous(ip)
+	if err != nil {
+		return nil, err
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		return nil, errors.New("Unable to encode json response for ip address: %s", ip)
+	}
+	server.cache.Add(cacheKey, jsonData)
+	return jsonData, nil
+}
+
+// LookupAnonymous resolves ip's anonymizing-network status using the
+// EditionAnonymousIP database, which must have been loaded.
+func (server *GeoServer) LookupAnonymous(ip string) (*geoip2.AnonymousIP, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, errors.New("unable to parse ip address %s", ip)
+	}
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return lookupAnonymous(server.dbs, parsedIP)
 }
 
 func (server *GeoServer) lookupDB(ip string) ([]byte, error) {
-	geoData, err := server.db.Country(net.ParseIP(ip))
+	result, err := server.Lookup(ip)
 	if err != nil {
-		return nil, errors.New("Unable to look up ip address %s: %s", ip, err)
+		return nil, err
 	}
-	jsonData, err := json.Marshal(geoData)
+	jsonData, err := json.Marshal(result)
 	if err != nil {
 		return nil, errors.New("Unable to encode json response for ip address: %s", ip)
 	}
 	return jsonData, nil
 }
 
-// keepDbCurrent checks the MaxMind database URL every hour and downloads it if it's
-// newer and submits it to server.dbUpdate for the run() routine to pick up.
-func (server *GeoServer) keepDbCurrent(lastModified time.Time) {
+// keepDbCurrent checks the given edition's database URL every hour and
+// downloads it if it's newer, swapping it into server.dbs under a write lock.
+// Transient failures (network errors, 5xx responses, HTTP/2 INTERNAL_ERROR
+// stream resets) are retried with backoff per retryOpts before giving up
+// until the next hourly check.
+func (server *GeoServer) keepDbCurrent(edition Edition, dbURL string, lastModified time.Time, retryOpts RetryOptions) {
 	for {
 		time.Sleep(1 * time.Hour)
-		db, modifiedTime, err := readDbFromWeb(server.dbURL, lastModified)
+		var db *geoip2.Reader
+		var modifiedTime time.Time
+		err := withRetry(retryOpts, func() error {
+			var e error
+			db, modifiedTime, e = readDbFromURL(edition, dbURL, lastModified)
+			return e
+		})
 		if err == errNotModified {
 			continue
 		}
 		if err != nil {
-			log.Errorf("Unable to update database from web: %s", err)
+			server.metrics.recordDbUpdateFailure(edition)
+			log.Errorf("Unable to update %s database from web: %s", edition, err)
 			continue
 		}
+		server.metrics.recordDbUpdateSuccess(edition, modifiedTime)
 		lastModified = modifiedTime
-		server.dbUpdate <- db
+		server.applyDbUpdate(edition, db)
 	}
 }
 
+// applyDbUpdate swaps in db as the reader for edition, closing the old reader
+// and purging the cache since previously cached results may now be stale.
+// This is the only place that takes server.mu for writing.
+func (server *GeoServer) applyDbUpdate(edition Edition, db *geoip2.Reader) {
+	server.mu.Lock()
+	old := server.dbs[edition]
+	server.dbs[edition] = db
+	server.mu.Unlock()
+	if old != nil {
+		log.Debugf("Closing old %s database", edition)
+		old.Close()
+	}
+	log.Debugf("Applied new %s database", edition)
+	server.cache.Purge()
+}
+
 // readDbFromFile reads the MaxMind database and timestamp from a file
 func readDbFromFile(dbFile string) (*geoip2.Reader, time.Time, error) {
 	dbData, err := ioutil.ReadFile(dbFile)
@@ -180,8 +367,40 @@ func readDbFromFile(dbFile string) (*geoip2.Reader, time.Time, error) {
 	}
 }
 
-// readDbFromWeb reads the MaxMind database and timestamp from the web
-func readDbFromWeb(url string, ifModifiedSince time.Time) (*geoip2.Reader, time.Time, error) {
+// readDbFromURL reads the MaxMind database and timestamp for the given edition
+// from dbURL, dispatching to the appropriate reader based on the URL's scheme.
+// A file:// URL is read directly off disk (using mtime in place of a
+// Last-Modified header); anything else is assumed to be an http(s) URL serving
+// a tar.gz archive.
+func readDbFromURL(edition Edition, dbURL string, ifModifiedSince time.Time) (*geoip2.Reader, time.Time, error) {
+	if strings.HasPrefix(dbURL, fileScheme) {
+		return readDbFromLocalFileIfModified(strings.TrimPrefix(dbURL, fileScheme), ifModifiedSince)
+	}
+	return readDbFromWeb(edition, dbURL, ifModifiedSince)
+}
+
+// readDbFromLocalFileIfModified reads the MaxMind database from dbFile, but only
+// if its mtime is after ifModifiedSince. This lets keepDbCurrent watch a file
+// maintained by an external process (e.g. geoipupdate) the same way it would
+// watch an HTTP URL's Last-Modified header.
+func readDbFromLocalFileIfModified(dbFile string, ifModifiedSince time.Time) (*geoip2.Reader, time.Time, error) {
+	fileInfo, err := os.Stat(dbFile)
+	if err != nil {
+		return nil, time.Time{}, errors.New("Unable to stat db file %s: %s", dbFile, err)
+	}
+	if !fileInfo.ModTime().After(ifModifiedSince) {
+		return nil, time.Time{}, errNotModified
+	}
+	db, lastModified, err := readDbFromFile(dbFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return db, lastModified, nil
+}
+
+// readDbFromWeb reads the MaxMind database and timestamp for the given edition
+// from the web
+func readDbFromWeb(edition Edition, url string, ifModifiedSince time.Time) (*geoip2.Reader, time.Time, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, time.Time{}, errors.New("unable to construct HTTP request for file: %v", err)
@@ -189,14 +408,14 @@ func readDbFromWeb(url string, ifModifiedSince time.Time) (*geoip2.Reader, time.
 	req.Header.Add("If-Modified-Since", ifModifiedSince.Format(http.TimeFormat))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, time.Time{}, errors.New("Unable to get database from %s: %s", url, err)
+		return nil, time.Time{}, fmt.Errorf("unable to get database from %s: %w", url, err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotModified {
 		return nil, time.Time{}, errNotModified
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, time.Time{}, errors.New("unexpected HTTP status %v", resp.Status)
+		return nil, time.Time{}, fmt.Errorf("unable to get database from %s: %w", url, &httpStatusError{status: resp.Status, statusCode: resp.StatusCode})
 	}
 	lastModified, err := getLastModified(resp)
 	if err != nil {
@@ -206,18 +425,18 @@ func readDbFromWeb(url string, ifModifiedSince time.Time) (*geoip2.Reader, time.
 	unzipper := archiver.NewTarGz()
 	err = unzipper.Open(resp.Body, 0)
 	if err != nil {
-		return nil, time.Time{}, errors.New("unable to unzip tar.gz: %v", err)
+		return nil, time.Time{}, fmt.Errorf("unable to unzip tar.gz: %w", err)
 	}
 	defer unzipper.Close()
 	for {
 		f, err := unzipper.Read()
 		if err != nil {
-			return nil, time.Time{}, errors.New("unable to read from tar.gz: %v", err)
+			return nil, time.Time{}, fmt.Errorf("unable to read from tar.gz: %w", err)
 		}
-		if f.Name() == "GeoLite2-Country.mmdb" {
+		if f.Name() == edition.mmdbFilename() {
 			dbData, err := ioutil.ReadAll(f)
 			if err != nil {
-				return nil, time.Time{}, errors.New("unable to read GeoLite2-Country.mmdb: %v", err)
+				return nil, time.Time{}, fmt.Errorf("unable to read %s: %w", f.Name(), err)
 			}
 			db, err := openDb(dbData)
 			if err != nil {
@@ -243,14 +462,3 @@ func openDb(dbData []byte) (*geoip2.Reader, error) {
 		return db, nil
 	}
 }
-
-func clientIpFor(req *http.Request) string {
-	// Client requested their info
-	clientIp := req.Header.Get("X-Forwarded-For")
-	if clientIp == "" {
-		clientIp = strings.Split(req.RemoteAddr, ":")[0]
-	}
-	// clientIp may contain multiple ips, use the first
-	ips := strings.Split(clientIp, ",")
-	return strings.TrimSpace(ips[0])
-}
@@ -0,0 +1,106 @@
+package geoserve
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// endpointGeo and endpointAnonymous label metrics shared between Handle
+	// and HandleAnonymous, so an operator can tell the two endpoints apart on
+	// a single /metrics scrape.
+	endpointGeo       = "geo"
+	endpointAnonymous = "anonymous"
+)
+
+// metrics holds the prometheus collectors for a single GeoServer. It's kept
+// separate from GeoServer's own state so that construction/registration
+// happens in one place.
+type metrics struct {
+	registry        *prometheus.Registry
+	cacheHits       *prometheus.CounterVec
+	cacheMisses     *prometheus.CounterVec
+	cacheSize       prometheus.GaugeFunc
+	lookupLatency   *prometheus.HistogramVec
+	dbUpdateSuccess *prometheus.CounterVec
+	dbUpdateFailure *prometheus.CounterVec
+	dbLastModified  *prometheus.GaugeVec
+	handleStatus    *prometheus.CounterVec
+}
+
+// newMetrics builds and registers a GeoServer's collectors. If reg is nil, a
+// dedicated registry is created, scrapable via GeoServer.MetricsHandler.
+// cacheLen is polled on every /metrics scrape to report the current cache size.
+func newMetrics(reg *prometheus.Registry, cacheLen func() int) *metrics {
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+	m := &metrics{
+		registry: reg,
+		cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoserve", Name: "cache_hits_total", Help: "Number of lookups served from the cache, by endpoint.",
+		}, []string{"endpoint"}),
+		cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoserve", Name: "cache_misses_total", Help: "Number of lookups that missed the cache, by endpoint.",
+		}, []string{"endpoint"}),
+		lookupLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "geoserve", Name: "lookup_latency_seconds", Help: "Latency of a single IP lookup, cache hit or miss, by endpoint.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		dbUpdateSuccess: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoserve", Name: "db_update_success_total", Help: "Number of successful database downloads, by edition.",
+		}, []string{"edition"}),
+		dbUpdateFailure: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoserve", Name: "db_update_failure_total", Help: "Number of failed database downloads, by edition.",
+		}, []string{"edition"}),
+		dbLastModified: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "geoserve", Name: "db_last_modified_timestamp_seconds", Help: "Last-Modified time of the currently loaded database, by edition.",
+		}, []string{"edition"}),
+		handleStatus: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoserve", Name: "handle_responses_total", Help: "Number of HTTP responses written by Handle/HandleAnonymous, by endpoint and status code.",
+		}, []string{"endpoint", "code"}),
+	}
+	m.cacheSize = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "geoserve", Name: "cache_size", Help: "Current number of entries in the lookup cache.",
+	}, func() float64 { return float64(cacheLen()) })
+	reg.MustRegister(
+		m.cacheHits, m.cacheMisses, m.cacheSize, m.lookupLatency,
+		m.dbUpdateSuccess, m.dbUpdateFailure, m.dbLastModified, m.handleStatus,
+	)
+	return m
+}
+
+func (m *metrics) recordDbUpdateSuccess(edition Edition, lastModified time.Time) {
+	m.dbUpdateSuccess.WithLabelValues(string(edition)).Inc()
+	m.dbLastModified.WithLabelValues(string(edition)).Set(float64(lastModified.Unix()))
+}
+
+func (m *metrics) recordDbUpdateFailure(edition Edition) {
+	m.dbUpdateFailure.WithLabelValues(string(edition)).Inc()
+}
+
+func (m *metrics) recordCacheHit(endpoint string) {
+	m.cacheHits.WithLabelValues(endpoint).Inc()
+}
+
+func (m *metrics) recordCacheMiss(endpoint string) {
+	m.cacheMisses.WithLabelValues(endpoint).Inc()
+}
+
+func (m *metrics) observeLookupLatency(endpoint string, d time.Duration) {
+	m.lookupLatency.WithLabelValues(endpoint).Observe(d.Seconds())
+}
+
+func (m *metrics) recordHandleStatus(endpoint string, statusCode int) {
+	m.handleStatus.WithLabelValues(endpoint, strconv.Itoa(statusCode)).Inc()
+}
+
+// MetricsHandler returns an http.Handler that serves this GeoServer's
+// prometheus metrics, suitable for mounting at e.g. /metrics.
+func (server *GeoServer) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(server.metrics.registry, promhttp.HandlerOpts{})
+}
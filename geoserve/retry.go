@@ -0,0 +1,110 @@
+package geoserve
+
+import (
+	gerrors "errors"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+)
+
+// RetryOptions controls how aggressively database downloads are retried on
+// transient failure.
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of attempts, including the first. A
+	// value <= 0 uses a default of 5.
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry; it doubles on each
+	// subsequent attempt. A value <= 0 uses a default of 2 seconds.
+	InitialDelay time.Duration
+}
+
+func (ro RetryOptions) withDefaults() RetryOptions {
+	if ro.MaxAttempts <= 0 {
+		ro.MaxAttempts = 5
+	}
+	if ro.InitialDelay <= 0 {
+		ro.InitialDelay = 2 * time.Second
+	}
+	return ro
+}
+
+// Options configures a GeoServer's database loading behavior.
+type Options struct {
+	// Retry controls retry/backoff behavior for downloading databases, both
+	// on initial load and on every keepDbCurrent check.
+	Retry RetryOptions
+	// Registry is an optional prometheus registry to register this server's
+	// metrics with. If nil, a dedicated registry is created, scrapable via
+	// GeoServer.MetricsHandler.
+	Registry *prometheus.Registry
+	// TrustedProxies lists CIDR ranges whose X-Forwarded-For, Forwarded and
+	// X-Real-IP headers are honored when determining the client IP for a
+	// request with no explicit path. If empty, those headers are never
+	// trusted and only RemoteAddr is used.
+	TrustedProxies []*net.IPNet
+	// CacheByNetwork, if true, keys the lookup cache by the containing /24
+	// (IPv4) or /48 (IPv6) network instead of the exact IP, trading precision
+	// for a much higher hit ratio on country/city-level lookups.
+	CacheByNetwork bool
+}
+
+func firstOptionsOrDefault(opts []Options) Options {
+	if len(opts) > 0 {
+		return opts[0]
+	}
+	return Options{}
+}
+
+// withRetry calls attempt, retrying with exponential backoff while it returns
+// a retryable error, up to ro.MaxAttempts times.
+func withRetry(ro RetryOptions, attempt func() error) error {
+	ro = ro.withDefaults()
+	delay := ro.InitialDelay
+	var err error
+	for i := 0; i < ro.MaxAttempts; i++ {
+		err = attempt()
+		if err == nil || err == errNotModified || !isRetryable(err) {
+			return err
+		}
+		if i == ro.MaxAttempts-1 {
+			break
+		}
+		log.Debugf("Attempt %d/%d failed with retryable error, retrying in %s: %s", i+1, ro.MaxAttempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+}
+
+// httpStatusError wraps an unexpected HTTP response status so that isRetryable
+// can tell 5xx responses (worth retrying) from 4xx ones (not).
+type httpStatusError struct {
+	status     string
+	statusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return "unexpected HTTP status " + e.status
+}
+
+// isRetryable reports whether err represents a transient failure worth
+// retrying: a 5xx HTTP status, a network-level error, or an HTTP/2
+// INTERNAL_ERROR stream reset, which MaxMind's CDN is known to emit
+// occasionally mid-download.
+func isRetryable(err error) bool {
+	var statusErr *httpStatusError
+	if gerrors.As(err, &statusErr) {
+		return statusErr.statusCode >= 500
+	}
+	var streamErr http2.StreamError
+	if gerrors.As(err, &streamErr) {
+		return streamErr.Code == http2.ErrCodeInternal
+	}
+	var netErr net.Error
+	if gerrors.As(err, &netErr) {
+		return true
+	}
+	return false
+}
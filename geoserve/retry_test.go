@@ -0,0 +1,123 @@
+package geoserve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"5xx status is retryable", &httpStatusError{status: "503 Service Unavailable", statusCode: 503}, true},
+		{"4xx status is not retryable", &httpStatusError{status: "404 Not Found", statusCode: 404}, false},
+		{"http2 INTERNAL_ERROR is retryable", http2.StreamError{Code: http2.ErrCodeInternal}, true},
+		{"other http2 stream error is not retryable", http2.StreamError{Code: http2.ErrCodeRefusedStream}, false},
+		{"wrapped network error is retryable", fmt.Errorf("download failed: %w", &net.DNSError{IsTimeout: true}), true},
+		{"plain error is not retryable", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRetrySucceedsWithoutRetry(t *testing.T) {
+	attempts := 0
+	err := withRetry(RetryOptions{MaxAttempts: 3, InitialDelay: time.Millisecond}, func() error {
+		attempts++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestWithRetryStopsOnNonRetryableError(t *testing.T) {
+	attempts := 0
+	wantErr := errors.New("permanent failure")
+	err := withRetry(RetryOptions{MaxAttempts: 3, InitialDelay: time.Millisecond}, func() error {
+		attempts++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("expected %v, got %v", wantErr, err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt for a non-retryable error, got %d", attempts)
+	}
+}
+
+func TestWithRetryStopsOnNotModified(t *testing.T) {
+	attempts := 0
+	err := withRetry(RetryOptions{MaxAttempts: 3, InitialDelay: time.Millisecond}, func() error {
+		attempts++
+		return errNotModified
+	})
+	if err != errNotModified {
+		t.Fatalf("expected errNotModified, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt for errNotModified, got %d", attempts)
+	}
+}
+
+func TestWithRetryExhaustsMaxAttemptsOnRetryableError(t *testing.T) {
+	attempts := 0
+	retryableErr := &httpStatusError{status: "503 Service Unavailable", statusCode: 503}
+	err := withRetry(RetryOptions{MaxAttempts: 3, InitialDelay: time.Millisecond}, func() error {
+		attempts++
+		return retryableErr
+	})
+	if err != retryableErr {
+		t.Fatalf("expected %v, got %v", retryableErr, err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts (MaxAttempts), got %d", attempts)
+	}
+}
+
+func TestWithRetrySucceedsAfterRetryableFailures(t *testing.T) {
+	attempts := 0
+	err := withRetry(RetryOptions{MaxAttempts: 5, InitialDelay: time.Millisecond}, func() error {
+		attempts++
+		if attempts < 3 {
+			return &httpStatusError{status: "503 Service Unavailable", statusCode: 503}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts before success, got %d", attempts)
+	}
+}
+
+func TestRetryOptionsWithDefaults(t *testing.T) {
+	defaults := RetryOptions{}.withDefaults()
+	if defaults.MaxAttempts <= 0 {
+		t.Errorf("expected a positive default MaxAttempts, got %d", defaults.MaxAttempts)
+	}
+	if defaults.InitialDelay <= 0 {
+		t.Errorf("expected a positive default InitialDelay, got %s", defaults.InitialDelay)
+	}
+
+	custom := RetryOptions{MaxAttempts: 7, InitialDelay: 3 * time.Second}.withDefaults()
+	if custom.MaxAttempts != 7 || custom.InitialDelay != 3*time.Second {
+		t.Errorf("withDefaults altered explicitly set values: got %+v", custom)
+	}
+}